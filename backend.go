@@ -0,0 +1,89 @@
+package blobstore
+
+import (
+	"fmt"
+	"io"
+
+	"labix.org/v2/mgo"
+)
+
+// ErrNotFound is returned by BlobBackend and RefCountStore
+// implementations when the named blob or reference-count record
+// does not exist. It is the same value as mgo.ErrNotFound so
+// that code written against the original GridFS-only Storage
+// keeps working unchanged.
+var ErrNotFound = mgo.ErrNotFound
+
+// ErrAlreadyExists is returned by RefCountStore.Create when a
+// record for the given name has already been created.
+var ErrAlreadyExists = fmt.Errorf("already exists")
+
+// BlobBackend stores the raw content of blobs, named by an
+// opaque string key (in practice, "blob-<sha256 hash>"). It
+// knows nothing about reference counting or hashes; that's the
+// job of RefCountStore and Storage respectively.
+type BlobBackend interface {
+	// OpenReader opens the blob with the given name for
+	// reading. It returns ErrNotFound if no such blob exists.
+	OpenReader(name string) (ReadSeekCloser, error)
+
+	// CreateWriter returns a writer that will store its content
+	// under name once Close is called. If a blob already exists
+	// under name, an implementation may either replace it or keep
+	// the existing content and discard the new one; the GridFS
+	// backend does the latter.
+	CreateWriter(name string) (BlobBackendWriter, error)
+
+	// Rename moves the blob stored under oldName so that it is
+	// subsequently available under newName. It returns
+	// ErrNotFound if no blob exists under oldName.
+	Rename(oldName, newName string) error
+
+	// Remove deletes the blob with the given name. It is not an
+	// error if no such blob exists.
+	Remove(name string) error
+
+	// StatSize returns the size of the blob with the given name,
+	// or ErrNotFound if it doesn't exist.
+	StatSize(name string) (int64, error)
+}
+
+// BlobBackendWriter writes a blob's content to a BlobBackend.
+type BlobBackendWriter interface {
+	io.Writer
+
+	// Abort discards everything written so far. The writer must
+	// not be used again afterwards.
+	Abort() error
+
+	// Close finalizes the blob under the name it was created
+	// with. The writer must not be used again afterwards.
+	Close() error
+}
+
+// RefCountStore tracks reference counts for the names held in a
+// BlobBackend, using whatever atomic compare-and-swap primitive
+// the underlying service provides (Mongo's findAndModify, a
+// local database transaction, S3 conditional writes, and so
+// on), so that concurrent callers racing to create or remove the
+// same blob see consistent results.
+type RefCountStore interface {
+	// Create initializes the reference count for name at 1. It
+	// returns ErrAlreadyExists if a record for name already
+	// exists.
+	Create(name string) error
+
+	// Increment atomically adds one to the reference count for
+	// name. It returns ErrNotFound if no record exists.
+	Increment(name string) error
+
+	// Decrement atomically subtracts one from the reference
+	// count for name and returns the new count. It returns
+	// ErrNotFound if no record exists.
+	Decrement(name string) (count int, err error)
+
+	// Remove deletes the record for name, but only if its count
+	// is still exactly zero; it reports whether it did so. It is
+	// not an error if no record exists.
+	Remove(name string) (removed bool, err error)
+}
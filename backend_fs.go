@@ -0,0 +1,208 @@
+package blobstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// fsBackend stores blobs as files in a local directory, sharded
+// into subdirectories by the first two characters of the hash
+// part of the name (the text after its last "-") so that no
+// single directory ends up with an unwieldy number of entries.
+type fsBackend struct {
+	dir string
+}
+
+// NewFSBackend returns a BlobBackend and RefCountStore that
+// store blobs as files under dir, which is created if
+// necessary. The RefCountStore's counts are not safe for
+// concurrent use from more than one process; pair it with
+// external locking, or with a different RefCountStore, if that
+// matters for a given deployment.
+func NewFSBackend(dir string) (BlobBackend, RefCountStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+	refDir := filepath.Join(dir, ".refcounts")
+	if err := os.MkdirAll(refDir, 0755); err != nil {
+		return nil, nil, err
+	}
+	return &fsBackend{dir: dir}, &fsRefCountStore{dir: refDir}, nil
+}
+
+func shardedPath(root, name string) string {
+	key := name[strings.LastIndex(name, "-")+1:]
+	if len(key) < 2 {
+		return filepath.Join(root, name)
+	}
+	return filepath.Join(root, key[:2], name)
+}
+
+func (b *fsBackend) OpenReader(name string) (ReadSeekCloser, error) {
+	f, err := os.Open(shardedPath(b.dir, name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (b *fsBackend) CreateWriter(name string) (BlobBackendWriter, error) {
+	path := shardedPath(b.dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return nil, err
+	}
+	return &fsWriter{tmp: tmp, finalPath: path}, nil
+}
+
+type fsWriter struct {
+	tmp       *os.File
+	finalPath string
+}
+
+func (w *fsWriter) Write(p []byte) (int, error) {
+	return w.tmp.Write(p)
+}
+
+func (w *fsWriter) Abort() error {
+	name := w.tmp.Name()
+	w.tmp.Close()
+	return os.Remove(name)
+}
+
+func (w *fsWriter) Close() error {
+	if err := w.tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(w.tmp.Name(), w.finalPath)
+}
+
+func (b *fsBackend) Rename(oldName, newName string) error {
+	newPath := shardedPath(b.dir, newName)
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return err
+	}
+	err := os.Rename(shardedPath(b.dir, oldName), newPath)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (b *fsBackend) Remove(name string) error {
+	err := os.Remove(shardedPath(b.dir, name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (b *fsBackend) StatSize(name string) (int64, error) {
+	fi, err := os.Stat(shardedPath(b.dir, name))
+	if os.IsNotExist(err) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// fsRefCountStore keeps each name's reference count in its own
+// file, named after the blob it refers to, inside a directory
+// separate from the blob content itself.
+type fsRefCountStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func (r *fsRefCountStore) path(name string) string {
+	return filepath.Join(r.dir, name)
+}
+
+func (r *fsRefCountStore) read(name string) (int, error) {
+	data, err := ioutil.ReadFile(r.path(name))
+	if os.IsNotExist(err) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	if _, err := fmt.Sscanf(string(data), "%d", &count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (r *fsRefCountStore) write(name string, count int) error {
+	return ioutil.WriteFile(r.path(name), []byte(fmt.Sprintf("%d", count)), 0644)
+}
+
+func (r *fsRefCountStore) Create(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, err := os.OpenFile(r.path(name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if os.IsExist(err) {
+		return ErrAlreadyExists
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%d", 1)
+	return err
+}
+
+func (r *fsRefCountStore) Increment(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count, err := r.read(name)
+	if err != nil {
+		return err
+	}
+	return r.write(name, count+1)
+}
+
+func (r *fsRefCountStore) Decrement(name string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count, err := r.read(name)
+	if err != nil {
+		return 0, err
+	}
+	count--
+	if err := r.write(name, count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (r *fsRefCountStore) Remove(name string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count, err := r.read(name)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if count != 0 {
+		return false, nil
+	}
+	if err := os.Remove(r.path(name)); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,185 @@
+package blobstore
+
+import (
+	"fmt"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// gridFSBackend stores blobs as named GridFS files.
+type gridFSBackend struct {
+	fs *mgo.GridFS
+}
+
+func newGridFSBackend(fs *mgo.GridFS) *gridFSBackend {
+	return &gridFSBackend{fs: fs}
+}
+
+func (b *gridFSBackend) OpenReader(name string) (ReadSeekCloser, error) {
+	f, err := b.fs.Open(name)
+	if err == mgo.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (b *gridFSBackend) CreateWriter(name string) (BlobBackendWriter, error) {
+	f, err := b.fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	f.SetName(name)
+	return &gridFSWriter{f: f}, nil
+}
+
+func (b *gridFSBackend) Rename(oldName, newName string) error {
+	err := b.fs.Files.Update(
+		bson.D{{"filename", oldName}},
+		bson.D{{"$set", bson.D{{"filename", newName}}}},
+	)
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (b *gridFSBackend) Remove(name string) error {
+	err := b.fs.Remove(name)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (b *gridFSBackend) StatSize(name string) (int64, error) {
+	f, err := b.fs.Open(name)
+	if err == mgo.ErrNotFound {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	size := f.Size()
+	f.Close()
+	return size, nil
+}
+
+// gridFSWriter adapts a *mgo.GridFile to BlobBackendWriter.
+type gridFSWriter struct {
+	f *mgo.GridFile
+}
+
+func (w *gridFSWriter) Write(p []byte) (int, error) {
+	return w.f.Write(p)
+}
+
+func (w *gridFSWriter) Abort() error {
+	w.f.Abort()
+	if err := w.f.Close(); err != nil {
+		// TODO add mgo.ErrAborted so that we can avoid a string error check.
+		if err.Error() != "write aborted" {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *gridFSWriter) Close() error {
+	err := w.f.Close()
+	if err == nil {
+		return nil
+	}
+	if mgo.IsDup(err) {
+		// Another writer has already finalized a file under the
+		// same name; since names are content-addressed, its
+		// content is identical to ours, so there's nothing more
+		// to do.
+		return nil
+	}
+	return err
+}
+
+// gridFSRefCountStore keeps reference counts in the metadata
+// field of the GridFS file they refer to, avoiding the need for
+// a separate collection. It holds the whole GridFS, rather than
+// just its Files collection, because Remove needs it to finish
+// deleting a file's chunks once it has claimed the file itself.
+type gridFSRefCountStore struct {
+	fs *mgo.GridFS
+}
+
+func (r *gridFSRefCountStore) Create(name string) error {
+	err := r.fs.Files.Update(
+		bson.D{{"filename", name}, {"metadata", nil}},
+		bson.D{{"$set", bson.D{{"metadata", refCountMeta{RefCount: 1}}}}},
+	)
+	if err == mgo.ErrNotFound {
+		return ErrAlreadyExists
+	}
+	return err
+}
+
+func (r *gridFSRefCountStore) Increment(name string) error {
+	err := r.fs.Files.Update(
+		bson.D{{"filename", name}},
+		bson.D{{"$inc", bson.D{{"metadata.refcount", 1}}}},
+	)
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (r *gridFSRefCountStore) Decrement(name string) (int, error) {
+	change := mgo.Change{
+		Update:    bson.D{{"$inc", bson.D{{"metadata.refcount", -1}}}},
+		ReturnNew: true,
+	}
+	var doc struct {
+		Metadata refCountMeta
+	}
+	_, err := r.fs.Files.Find(bson.D{{"filename", name}}).Apply(change, &doc)
+	if err == mgo.ErrNotFound {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return doc.Metadata.RefCount, nil
+}
+
+// Remove claims and deletes the file with the given name, but
+// only if its reference count is still exactly zero. As in the
+// original GridFS-only Storage.Remove, this can't be done with a
+// single atomic delete, since removing a GridFS file means
+// removing both its Files document and its Chunks, so Remove
+// first atomically renames the Files document to a tombstone
+// name conditioned on the filename and zero refcount matching,
+// which is what actually claims it: once renamed, a concurrent
+// Increment racing against us finds no document under the
+// original name and fails with ErrNotFound, rather than
+// incrementing a count we're about to delete out from under it.
+// Only then does it remove the file under its new name, which
+// also cleans up its chunks.
+func (r *gridFSRefCountStore) Remove(name string) (bool, error) {
+	tombstone := "deleted-" + bson.NewObjectId().Hex()
+	err := r.fs.Files.Update(
+		bson.D{{"filename", name}, {"metadata.refcount", 0}},
+		bson.D{{"$set", bson.D{{"filename", tombstone}}}},
+	)
+	if err == mgo.ErrNotFound {
+		// Someone else got there first.
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("cannot rename file before deletion: %v", err)
+	}
+	if err := r.fs.Remove(tombstone); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,156 @@
+package blobstore
+
+import (
+	"bytes"
+	"sync"
+)
+
+// memoryBackend is an in-memory BlobBackend, mainly useful for
+// tests.
+type memoryBackend struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+// NewMemoryBackend returns a BlobBackend that holds blobs in
+// memory. It is not persisted and is intended for tests.
+func NewMemoryBackend() BlobBackend {
+	return &memoryBackend{data: make(map[string][]byte)}
+}
+
+func (b *memoryBackend) OpenReader(name string) (ReadSeekCloser, error) {
+	b.mu.Lock()
+	data, ok := b.data[name]
+	b.mu.Unlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &memoryReader{r: bytes.NewReader(data)}, nil
+}
+
+type memoryReader struct {
+	r *bytes.Reader
+}
+
+func (r *memoryReader) Read(p []byte) (int, error) {
+	return r.r.Read(p)
+}
+
+func (r *memoryReader) Seek(offset int64, whence int) (int64, error) {
+	return r.r.Seek(offset, whence)
+}
+
+func (r *memoryReader) Close() error {
+	return nil
+}
+
+func (b *memoryBackend) CreateWriter(name string) (BlobBackendWriter, error) {
+	return &memoryWriter{b: b, name: name}, nil
+}
+
+type memoryWriter struct {
+	b    *memoryBackend
+	name string
+	buf  bytes.Buffer
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *memoryWriter) Abort() error {
+	w.buf.Reset()
+	return nil
+}
+
+func (w *memoryWriter) Close() error {
+	w.b.mu.Lock()
+	w.b.data[w.name] = append([]byte(nil), w.buf.Bytes()...)
+	w.b.mu.Unlock()
+	return nil
+}
+
+func (b *memoryBackend) Rename(oldName, newName string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, ok := b.data[oldName]
+	if !ok {
+		return ErrNotFound
+	}
+	b.data[newName] = data
+	delete(b.data, oldName)
+	return nil
+}
+
+func (b *memoryBackend) Remove(name string) error {
+	b.mu.Lock()
+	delete(b.data, name)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *memoryBackend) StatSize(name string) (int64, error) {
+	b.mu.Lock()
+	data, ok := b.data[name]
+	b.mu.Unlock()
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return int64(len(data)), nil
+}
+
+// memoryRefCountStore is an in-memory RefCountStore, mainly
+// useful for tests and for pairing with NewMemoryBackend.
+type memoryRefCountStore struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// NewMemoryRefCountStore returns a RefCountStore that holds
+// reference counts in memory.
+func NewMemoryRefCountStore() RefCountStore {
+	return &memoryRefCountStore{counts: make(map[string]int)}
+}
+
+func (s *memoryRefCountStore) Create(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.counts[name]; ok {
+		return ErrAlreadyExists
+	}
+	s.counts[name] = 1
+	return nil
+}
+
+func (s *memoryRefCountStore) Increment(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.counts[name]; !ok {
+		return ErrNotFound
+	}
+	s.counts[name]++
+	return nil
+}
+
+func (s *memoryRefCountStore) Decrement(name string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count, ok := s.counts[name]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	count--
+	s.counts[name] = count
+	return count, nil
+}
+
+func (s *memoryRefCountStore) Remove(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count, ok := s.counts[name]
+	if !ok || count != 0 {
+		return false, nil
+	}
+	delete(s.counts, name)
+	return true, nil
+}
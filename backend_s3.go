@@ -0,0 +1,261 @@
+package blobstore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// s3Backend stores blobs as objects in an S3-compatible bucket,
+// keyed by joining prefix with the blob name.
+type s3Backend struct {
+	svc    *s3.S3
+	bucket string
+	prefix string
+}
+
+// NewS3Backend returns a BlobBackend that stores blobs as
+// objects in bucket, under the given key prefix, using svc. S3
+// has no native atomic counter, so this is not paired with a
+// RefCountStore automatically; use NewS3RefCountStore alongside
+// it, with a different prefix, or bring a store backed by
+// another service instead.
+func NewS3Backend(svc *s3.S3, bucket, prefix string) BlobBackend {
+	return &s3Backend{svc: svc, bucket: bucket, prefix: prefix}
+}
+
+func (b *s3Backend) key(name string) string {
+	return b.prefix + name
+}
+
+func isS3NotFound(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && (aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound")
+}
+
+func (b *s3Backend) OpenReader(name string) (ReadSeekCloser, error) {
+	out, err := b.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.key(name)),
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	defer out.Body.Close()
+	data, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryReader{r: bytes.NewReader(data)}, nil
+}
+
+func (b *s3Backend) CreateWriter(name string) (BlobBackendWriter, error) {
+	return &s3Writer{b: b, name: name}, nil
+}
+
+// s3Writer buffers the whole blob in memory before uploading it
+// in a single PutObject call on Close, since S3 has no API for
+// appending to an object incrementally.
+type s3Writer struct {
+	b    *s3Backend
+	name string
+	buf  bytes.Buffer
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *s3Writer) Abort() error {
+	w.buf.Reset()
+	return nil
+}
+
+func (w *s3Writer) Close() error {
+	_, err := w.b.svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(w.b.bucket),
+		Key:    aws.String(w.b.key(w.name)),
+		Body:   bytes.NewReader(w.buf.Bytes()),
+	})
+	return err
+}
+
+func (b *s3Backend) Rename(oldName, newName string) error {
+	_, err := b.svc.CopyObject(&s3.CopyObjectInput{
+		Bucket:     aws.String(b.bucket),
+		CopySource: aws.String(b.bucket + "/" + b.key(oldName)),
+		Key:        aws.String(b.key(newName)),
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return b.Remove(oldName)
+}
+
+func (b *s3Backend) Remove(name string) error {
+	_, err := b.svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.key(name)),
+	})
+	return err
+}
+
+func (b *s3Backend) StatSize(name string) (int64, error) {
+	out, err := b.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.key(name)),
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			return 0, ErrNotFound
+		}
+		return 0, err
+	}
+	if out.ContentLength == nil {
+		return 0, nil
+	}
+	return *out.ContentLength, nil
+}
+
+// s3RefCountStore keeps each name's reference count in a small
+// object of its own, stored in bucket under prefix, using S3's
+// conditional-write preconditions (If-None-Match and If-Match)
+// in place of the atomic counter S3 doesn't have natively.
+type s3RefCountStore struct {
+	svc    *s3.S3
+	bucket string
+	prefix string
+}
+
+// NewS3RefCountStore returns a RefCountStore that keeps reference
+// counts as objects in bucket, under the given key prefix, using
+// svc's support for conditional writes. prefix should not overlap
+// the prefix given to NewS3Backend or any other store sharing the
+// bucket, so that refcount objects can't collide with blob content.
+func NewS3RefCountStore(svc *s3.S3, bucket, prefix string) RefCountStore {
+	return &s3RefCountStore{svc: svc, bucket: bucket, prefix: prefix}
+}
+
+func (r *s3RefCountStore) key(name string) string {
+	return r.prefix + name
+}
+
+func isS3PreconditionFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && (aerr.Code() == "PreconditionFailed" || aerr.Code() == "ConditionalRequestConflict")
+}
+
+// get returns the current count for name along with the ETag it
+// was read under, so a later update can be conditioned on it.
+func (r *s3RefCountStore) get(name string) (count int, etag string, err error) {
+	out, err := r.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(r.key(name)),
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			return 0, "", ErrNotFound
+		}
+		return 0, "", err
+	}
+	defer out.Body.Close()
+	data, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return 0, "", err
+	}
+	if _, err := fmt.Sscanf(string(data), "%d", &count); err != nil {
+		return 0, "", err
+	}
+	if out.ETag == nil {
+		return 0, "", fmt.Errorf("refcount object has no ETag")
+	}
+	return count, *out.ETag, nil
+}
+
+func (r *s3RefCountStore) Create(name string) error {
+	_, err := r.svc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(r.bucket),
+		Key:         aws.String(r.key(name)),
+		Body:        bytes.NewReader([]byte("1")),
+		IfNoneMatch: aws.String("*"),
+	})
+	if err != nil {
+		if isS3PreconditionFailed(err) {
+			return ErrAlreadyExists
+		}
+		return err
+	}
+	return nil
+}
+
+// addCount applies delta to name's stored count, retrying the
+// conditional write if another caller updates it first.
+func (r *s3RefCountStore) addCount(name string, delta int) (int, error) {
+	for {
+		count, etag, err := r.get(name)
+		if err != nil {
+			return 0, err
+		}
+		count += delta
+		_, err = r.svc.PutObject(&s3.PutObjectInput{
+			Bucket:  aws.String(r.bucket),
+			Key:     aws.String(r.key(name)),
+			Body:    bytes.NewReader([]byte(fmt.Sprintf("%d", count))),
+			IfMatch: aws.String(etag),
+		})
+		if err == nil {
+			return count, nil
+		}
+		if isS3PreconditionFailed(err) {
+			// Someone else updated the count first; reread and
+			// retry.
+			continue
+		}
+		return 0, err
+	}
+}
+
+func (r *s3RefCountStore) Increment(name string) error {
+	_, err := r.addCount(name, 1)
+	return err
+}
+
+func (r *s3RefCountStore) Decrement(name string) (int, error) {
+	return r.addCount(name, -1)
+}
+
+func (r *s3RefCountStore) Remove(name string) (bool, error) {
+	count, etag, err := r.get(name)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if count != 0 {
+		return false, nil
+	}
+	_, err = r.svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket:  aws.String(r.bucket),
+		Key:     aws.String(r.key(name)),
+		IfMatch: aws.String(etag),
+	})
+	if err != nil {
+		if isS3PreconditionFailed(err) || isS3NotFound(err) {
+			// Someone else incremented or removed it first.
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,86 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	"github.com/rogpeppe/blobstore"
+	gc "launchpad.net/gocheck"
+)
+
+// backendSuite exercises Storage against a pluggable backend
+// that doesn't need a Mongo connection, unlike storeSuite.
+type backendSuite struct{}
+
+var _ = gc.Suite(&backendSuite{})
+
+func (s *backendSuite) TestMemoryBackendCreateOpenCheckRemove(c *gc.C) {
+	store := blobstore.NewWithBackend(blobstore.NewMemoryBackend(), blobstore.NewMemoryRefCountStore())
+
+	data := []byte(`some file data`)
+	hash := hashOf(data)
+
+	exists, err := store.Create(hash, bytes.NewReader(data))
+	c.Assert(err, gc.IsNil)
+	c.Assert(exists, gc.Equals, false)
+
+	f, err := store.Open(hash)
+	c.Assert(err, gc.IsNil)
+	gotData, err := ioutil.ReadAll(f)
+	c.Assert(err, gc.IsNil)
+	c.Assert(f.Close(), gc.IsNil)
+	c.Assert(gotData, gc.DeepEquals, data)
+
+	ok, size, err := store.Check(hash)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(size, gc.Equals, int64(len(data)))
+
+	// A second Create reuses the existing content.
+	exists, err = store.Create(hash, bytes.NewReader(data))
+	c.Assert(err, gc.IsNil)
+	c.Assert(exists, gc.Equals, true)
+
+	c.Assert(store.Remove(hash), gc.IsNil)
+	ok, _, err = store.Check(hash)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+
+	c.Assert(store.Remove(hash), gc.IsNil)
+	_, err = store.Open(hash)
+	c.Assert(err, gc.Equals, blobstore.ErrNotFound)
+}
+
+func (s *backendSuite) TestMemoryBackendDoesNotSupportResumableUploads(c *gc.C) {
+	store := blobstore.NewWithBackend(blobstore.NewMemoryBackend(), blobstore.NewMemoryRefCountStore())
+
+	_, err := store.CreateWriter(hashOf([]byte("x")))
+	c.Assert(err, gc.ErrorMatches, ".*Mongo-backed Storage")
+
+	_, err = store.CreateAt(hashOf([]byte("x")), 1)
+	c.Assert(err, gc.ErrorMatches, ".*Mongo-backed Storage")
+}
+
+func (s *backendSuite) TestFSBackendCreateOpenRemove(c *gc.C) {
+	backend, refs, err := blobstore.NewFSBackend(c.MkDir())
+	c.Assert(err, gc.IsNil)
+	store := blobstore.NewWithBackend(backend, refs)
+
+	data := []byte(`some file data stored on disk`)
+	hash := hashOf(data)
+
+	exists, err := store.Create(hash, bytes.NewReader(data))
+	c.Assert(err, gc.IsNil)
+	c.Assert(exists, gc.Equals, false)
+
+	f, err := store.Open(hash)
+	c.Assert(err, gc.IsNil)
+	gotData, err := ioutil.ReadAll(f)
+	c.Assert(err, gc.IsNil)
+	c.Assert(f.Close(), gc.IsNil)
+	c.Assert(gotData, gc.DeepEquals, data)
+
+	c.Assert(store.Remove(hash), gc.IsNil)
+	_, err = store.Open(hash)
+	c.Assert(err, gc.Equals, blobstore.ErrNotFound)
+}
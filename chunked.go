@@ -0,0 +1,410 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Chunk size bounds for content-defined chunking. A boundary is
+// never emitted before minChunkSize bytes of the current chunk
+// have been seen, and is always emitted at maxChunkSize bytes
+// even if the rolling hash hasn't found one, so that a single
+// run of incompressible data can't produce an unbounded chunk.
+const (
+	minChunkSize = 512 * 1024
+	avgChunkSize = 1024 * 1024
+	maxChunkSize = 8 * 1024 * 1024
+
+	rollingWindow = 64
+)
+
+// chunkMask selects a boundary on average every avgChunkSize
+// bytes, since avgChunkSize is a power of two.
+const chunkMask = avgChunkSize - 1
+
+func manifestName(h string) string {
+	return "manifest-" + h
+}
+
+// manifestMeta describes a logical blob that has been split
+// into content-defined chunks, each stored as its own
+// reference-counted blob keyed by its own sha256 hash.
+type manifestMeta struct {
+	RefCount    int
+	Size        int64
+	ChunkHashes []string
+	ChunkSizes  []int64
+}
+
+// buzhashTable holds a fixed pseudo-random value per byte value,
+// used to give each byte roughly independent influence over the
+// rolling hash. It is generated once at init time rather than
+// hard-coded so that the source doesn't need to carry a 256-entry
+// magic table.
+var buzhashTable [256]uint64
+
+func init() {
+	x := uint64(0x9e3779b97f4a7c15)
+	for i := range buzhashTable {
+		x ^= x << 13
+		x ^= x >> 7
+		x ^= x << 17
+		buzhashTable[i] = x
+	}
+}
+
+func rol64(x uint64, n uint) uint64 {
+	return (x << n) | (x >> (64 - n))
+}
+
+// chunker splits a stream into content-defined chunks using a
+// buzhash rolling hash over a sliding window: a boundary falls
+// wherever the bits of the hash selected by chunkMask are all
+// zero, which is
+// stable under insertions and deletions elsewhere in the
+// stream, giving good deduplication across similar blobs.
+type chunker struct {
+	r      *bufReader
+	window [rollingWindow]byte
+	pos    int
+	filled int
+	hash   uint64
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: newBufReader(r)}
+}
+
+// next returns the next chunk, or io.EOF if the underlying
+// stream is exhausted.
+func (c *chunker) next() ([]byte, error) {
+	var buf []byte
+	for {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			if len(buf) == 0 {
+				return nil, io.EOF
+			}
+			return buf, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, b)
+
+		out := c.window[c.pos]
+		c.window[c.pos] = b
+		c.pos = (c.pos + 1) % rollingWindow
+		if c.filled < rollingWindow {
+			c.filled++
+		}
+		c.hash = rol64(c.hash, 1) ^ rol64(buzhashTable[out], rollingWindow%64) ^ buzhashTable[b]
+
+		if len(buf) >= maxChunkSize {
+			return buf, nil
+		}
+		if len(buf) >= minChunkSize && c.filled == rollingWindow && c.hash&chunkMask == 0 {
+			return buf, nil
+		}
+	}
+}
+
+// bufReader is a minimal byte-at-a-time buffered reader; it
+// exists so chunker doesn't need to depend on bufio for such a
+// small amount of buffering logic.
+type bufReader struct {
+	r   io.Reader
+	buf []byte
+	pos int
+}
+
+func newBufReader(r io.Reader) *bufReader {
+	return &bufReader{r: r, buf: make([]byte, 32*1024)}
+}
+
+func (r *bufReader) ReadByte() (byte, error) {
+	if r.pos >= len(r.buf) {
+		n, err := r.r.Read(r.buf[:cap(r.buf)])
+		if n == 0 {
+			if err == nil {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		r.buf = r.buf[:n]
+		r.pos = 0
+	}
+	b := r.buf[r.pos]
+	r.pos++
+	return b, nil
+}
+
+// createChunked implements Create for a Storage in chunked
+// mode: it splits r into content-defined chunks, stores each
+// chunk as an ordinary reference-counted blob, and records the
+// result as a manifest document rather than a single GridFS
+// file.
+func (s *Storage) createChunked(sha256Hash string, r io.Reader) (alreadyExists bool, err error) {
+	if s.manifests == nil {
+		return false, fmt.Errorf("chunked mode requires a Mongo-backed Storage")
+	}
+	manifestRef := manifestName(sha256Hash)
+	err = s.incManifestRefCount(manifestRef)
+	if err == nil {
+		return true, nil
+	}
+	if err != mgo.ErrNotFound {
+		return false, err
+	}
+
+	hasher := sha256.New()
+	c := newChunker(io.TeeReader(r, hasher))
+	var chunkHashes []string
+	var chunkSizes []int64
+	var total int64
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			s.removeChunks(chunkHashes)
+			return false, err
+		}
+		chunkHash := fmt.Sprintf("%x", sha256.Sum256(chunk))
+		if _, err := s.createPlain(Digest{Algorithm: "sha256", Hex: chunkHash}, bytes.NewReader(chunk)); err != nil {
+			s.removeChunks(chunkHashes)
+			return false, fmt.Errorf("cannot store chunk: %v", err)
+		}
+		chunkHashes = append(chunkHashes, chunkHash)
+		chunkSizes = append(chunkSizes, int64(len(chunk)))
+		total += int64(len(chunk))
+	}
+	if actual := fmt.Sprintf("%x", hasher.Sum(nil)); actual != sha256Hash {
+		s.removeChunks(chunkHashes)
+		return false, fmt.Errorf("file checksum mismatch")
+	}
+
+	err = s.manifests.Insert(bson.D{
+		{"filename", manifestRef},
+		{"metadata", manifestMeta{
+			RefCount:    1,
+			Size:        total,
+			ChunkHashes: chunkHashes,
+			ChunkSizes:  chunkSizes,
+		}},
+	})
+	if err == nil {
+		return false, nil
+	}
+	if !mgo.IsDup(err) {
+		return false, err
+	}
+	// Someone else created the same manifest first.
+	if err := s.incManifestRefCount(manifestRef); err != nil {
+		return false, fmt.Errorf("cannot increment manifest ref count: %v", err)
+	}
+	s.removeChunks(chunkHashes)
+	return false, nil
+}
+
+func (s *Storage) removeChunks(chunkHashes []string) {
+	for _, h := range chunkHashes {
+		if err := s.Remove(h); err != nil {
+			log.Printf("cannot remove chunk %s after failed upload: %v", h, err)
+		}
+	}
+}
+
+func (s *Storage) incManifestRefCount(manifestRef string) error {
+	return s.manifests.Update(
+		bson.D{{"filename", manifestRef}},
+		bson.D{{"$inc", bson.D{{"metadata.refcount", 1}}}},
+	)
+}
+
+func (s *Storage) checkManifest(sha256Hash string) (exists bool, size int64, err error) {
+	if s.manifests == nil {
+		return false, 0, nil
+	}
+	var doc struct {
+		Metadata manifestMeta
+	}
+	err = s.manifests.Find(bson.D{{"filename", manifestName(sha256Hash)}}).One(&doc)
+	if err == mgo.ErrNotFound {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	return true, doc.Metadata.Size, nil
+}
+
+func (s *Storage) removeManifest(sha256Hash string) error {
+	if s.manifests == nil {
+		return ErrNotFound
+	}
+	manifestRef := manifestName(sha256Hash)
+	change := mgo.Change{
+		Update:    bson.D{{"$inc", bson.D{{"metadata.refcount", -1}}}},
+		ReturnNew: true,
+	}
+	var doc struct {
+		Metadata manifestMeta
+	}
+	_, err := s.manifests.Find(bson.D{{"filename", manifestRef}}).Apply(change, &doc)
+	if err != nil {
+		return err
+	}
+	if doc.Metadata.RefCount != 0 {
+		return nil
+	}
+	err = s.manifests.Remove(bson.D{{"filename", manifestRef}, {"metadata.refcount", 0}})
+	if err == mgo.ErrNotFound {
+		// Someone else got there first.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, h := range doc.Metadata.ChunkHashes {
+		if err := s.Remove(h); err != nil {
+			return fmt.Errorf("cannot remove chunk %s: %v", h, err)
+		}
+	}
+	return nil
+}
+
+// openManifest returns a ReadSeekCloser over the chunks
+// recorded in the manifest for sha256Hash.
+func (s *Storage) openManifest(sha256Hash string) (ReadSeekCloser, error) {
+	if s.manifests == nil {
+		return nil, ErrNotFound
+	}
+	var doc struct {
+		Metadata manifestMeta
+	}
+	err := s.manifests.Find(bson.D{{"filename", manifestName(sha256Hash)}}).One(&doc)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make([]int64, len(doc.Metadata.ChunkSizes)+1)
+	for i, size := range doc.Metadata.ChunkSizes {
+		offsets[i+1] = offsets[i] + size
+	}
+	return &chunkReader{
+		s:       s,
+		hashes:  doc.Metadata.ChunkHashes,
+		offsets: offsets,
+		curIdx:  -1,
+	}, nil
+}
+
+// chunkReader transparently concatenates the chunks of a
+// manifest into a single seekable stream.
+type chunkReader struct {
+	s       *Storage
+	hashes  []string
+	offsets []int64 // cumulative size before chunk i, plus total size at the end
+	pos     int64
+	curIdx  int
+	cur     ReadSeekCloser
+}
+
+func (cr *chunkReader) total() int64 {
+	return cr.offsets[len(cr.offsets)-1]
+}
+
+// chunkAt returns the index of the chunk containing byte offset
+// off.
+func (cr *chunkReader) chunkAt(off int64) int {
+	lo, hi := 0, len(cr.hashes)-1
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if cr.offsets[mid] <= off {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo
+}
+
+func (cr *chunkReader) ensureOpen(idx int) error {
+	if cr.curIdx == idx && cr.cur != nil {
+		return nil
+	}
+	if cr.cur != nil {
+		cr.cur.Close()
+		cr.cur = nil
+	}
+	f, err := cr.s.Open(cr.hashes[idx])
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(cr.pos-cr.offsets[idx], io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	cr.cur = f
+	cr.curIdx = idx
+	return nil
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if cr.pos >= cr.total() {
+		return 0, io.EOF
+	}
+	idx := cr.chunkAt(cr.pos)
+	if err := cr.ensureOpen(idx); err != nil {
+		return 0, err
+	}
+	max := cr.offsets[idx+1] - cr.pos
+	if int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := cr.cur.Read(p)
+	cr.pos += int64(n)
+	if err == io.EOF && cr.pos < cr.total() {
+		err = nil
+	}
+	return n, err
+}
+
+func (cr *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	var newPos int64
+	switch whence {
+	case io.SeekStart:
+		newPos = offset
+	case io.SeekCurrent:
+		newPos = cr.pos + offset
+	case io.SeekEnd:
+		newPos = cr.total() + offset
+	default:
+		return 0, fmt.Errorf("invalid whence")
+	}
+	if newPos < 0 || newPos > cr.total() {
+		return 0, fmt.Errorf("seek out of range")
+	}
+	if newPos != cr.pos && cr.cur != nil {
+		// Drop the open chunk so that the next Read reopens it
+		// at the new position.
+		cr.cur.Close()
+		cr.cur = nil
+	}
+	cr.pos = newPos
+	return cr.pos, nil
+}
+
+func (cr *chunkReader) Close() error {
+	if cr.cur != nil {
+		return cr.cur.Close()
+	}
+	return nil
+}
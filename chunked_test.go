@@ -0,0 +1,81 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	"github.com/rogpeppe/blobstore"
+	"labix.org/v2/mgo"
+	gc "launchpad.net/gocheck"
+)
+
+func (s *storeSuite) TestChunkedCreateOpenCheck(c *gc.C) {
+	store := blobstore.New(s.Session.DB("a-database"), "prefix", blobstore.Chunked())
+
+	data := make([]byte, 5*1024*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	hash := hashOf(data)
+
+	exists, err := store.Create(hash, bytes.NewReader(data))
+	c.Assert(err, gc.IsNil)
+	c.Assert(exists, gc.Equals, false)
+
+	f, err := store.Open(hash)
+	c.Assert(err, gc.IsNil)
+	defer f.Close()
+	gotData, err := ioutil.ReadAll(f)
+	c.Assert(err, gc.IsNil)
+	c.Assert(gotData, gc.DeepEquals, data)
+
+	ok, size, err := store.Check(hash)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(size, gc.Equals, int64(len(data)))
+}
+
+func (s *storeSuite) TestChunkedRemove(c *gc.C) {
+	store := blobstore.New(s.Session.DB("a-database"), "prefix", blobstore.Chunked())
+
+	data := bytes.Repeat([]byte("abcdefgh"), 200*1024)
+	hash := hashOf(data)
+
+	_, err := store.Create(hash, bytes.NewReader(data))
+	c.Assert(err, gc.IsNil)
+
+	c.Assert(store.Remove(hash), gc.IsNil)
+
+	_, err = store.Open(hash)
+	c.Assert(err, gc.Equals, mgo.ErrNotFound)
+}
+
+func (s *storeSuite) TestChunkedBlobsWithSharedContent(c *gc.C) {
+	store := blobstore.New(s.Session.DB("a-database"), "prefix", blobstore.Chunked())
+
+	shared := bytes.Repeat([]byte("shared content "), 100*1024)
+	dataA := append(append([]byte{}, shared...), []byte("tail A")...)
+	dataB := append(append([]byte{}, shared...), []byte("tail B")...)
+
+	hashA := hashOf(dataA)
+	hashB := hashOf(dataB)
+
+	_, err := store.Create(hashA, bytes.NewReader(dataA))
+	c.Assert(err, gc.IsNil)
+	_, err = store.Create(hashB, bytes.NewReader(dataB))
+	c.Assert(err, gc.IsNil)
+
+	fA, err := store.Open(hashA)
+	c.Assert(err, gc.IsNil)
+	defer fA.Close()
+	gotA, err := ioutil.ReadAll(fA)
+	c.Assert(err, gc.IsNil)
+	c.Assert(gotA, gc.DeepEquals, dataA)
+
+	fB, err := store.Open(hashB)
+	c.Assert(err, gc.IsNil)
+	defer fB.Close()
+	gotB, err := ioutil.ReadAll(fB)
+	c.Assert(err, gc.IsNil)
+	c.Assert(gotB, gc.DeepEquals, dataB)
+}
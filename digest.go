@@ -0,0 +1,73 @@
+package blobstore
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// Digest identifies a blob's content by the algorithm used to
+// hash it and the resulting hash value, hex-encoded. Its string
+// form, "algorithm:hex", follows the same multihash-style
+// convention used for content addressing in container registries
+// and similar systems, so that a Digest is self-describing
+// wherever it's logged or stored.
+type Digest struct {
+	Algorithm string
+	Hex       string
+}
+
+func (d Digest) String() string {
+	return d.Algorithm + ":" + d.Hex
+}
+
+// ParseDigest parses s as a Digest in "algorithm:hex" form.
+//
+// Deprecated: for backward compatibility with callers written
+// against earlier versions of this package, a string with no
+// colon is treated as a bare hex-encoded SHA-256 hash, equivalent
+// to Digest{Algorithm: "sha256", Hex: s}. New callers should use
+// an explicit "algorithm:hex" string instead.
+func ParseDigest(s string) (Digest, error) {
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		d := Digest{Algorithm: s[:i], Hex: s[i+1:]}
+		if d.Hex == "" {
+			return Digest{}, fmt.Errorf("digest %q has no hash value", s)
+		}
+		return d, nil
+	}
+	if s == "" {
+		return Digest{}, fmt.Errorf("empty digest")
+	}
+	return Digest{Algorithm: "sha256", Hex: s}, nil
+}
+
+// hashConstructors holds the hash algorithms that can be used in
+// a Digest, keyed by the name used in its Algorithm field.
+var hashConstructors = map[string]func() hash.Hash{}
+
+// RegisterHash makes the hash algorithm newHash available for use
+// in a Digest under the given name. It is intended to be called
+// from the init function of a package that adds support for an
+// algorithm not registered by this package, such as blake3.
+// Registering a name a second time replaces the previous entry.
+func RegisterHash(name string, newHash func() hash.Hash) {
+	hashConstructors[name] = newHash
+}
+
+func init() {
+	RegisterHash("sha256", sha256.New)
+	RegisterHash("sha512-256", sha512.New512_256)
+}
+
+// newHasher returns a new hash.Hash for the given algorithm name,
+// or an error if it hasn't been registered with RegisterHash.
+func newHasher(algorithm string) (hash.Hash, error) {
+	newHash, ok := hashConstructors[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash algorithm %q", algorithm)
+	}
+	return newHash(), nil
+}
@@ -0,0 +1,97 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/rogpeppe/blobstore"
+	gc "launchpad.net/gocheck"
+)
+
+// digestSuite exercises ParseDigest, which doesn't need a Mongo
+// connection.
+type digestSuite struct{}
+
+var _ = gc.Suite(&digestSuite{})
+
+func (s *digestSuite) TestParseDigest(c *gc.C) {
+	d, err := blobstore.ParseDigest("sha512-256:abcd")
+	c.Assert(err, gc.IsNil)
+	c.Assert(d, gc.Equals, blobstore.Digest{Algorithm: "sha512-256", Hex: "abcd"})
+	c.Assert(d.String(), gc.Equals, "sha512-256:abcd")
+}
+
+func (s *digestSuite) TestParseDigestBareHexIsSHA256(c *gc.C) {
+	d, err := blobstore.ParseDigest("abcd")
+	c.Assert(err, gc.IsNil)
+	c.Assert(d, gc.Equals, blobstore.Digest{Algorithm: "sha256", Hex: "abcd"})
+}
+
+func (s *digestSuite) TestParseDigestEmpty(c *gc.C) {
+	_, err := blobstore.ParseDigest("")
+	c.Assert(err, gc.ErrorMatches, "empty digest")
+}
+
+func (s *digestSuite) TestParseDigestNoHash(c *gc.C) {
+	_, err := blobstore.ParseDigest("sha256:")
+	c.Assert(err, gc.ErrorMatches, `digest "sha256:" has no hash value`)
+}
+
+// storeSuite additions exercising multihash-style digests against
+// a real Storage; these live here, alongside the rest of the
+// digest-related tests, rather than in store_test.go.
+
+func (s *storeSuite) TestCreateOpenWithAlgorithm(c *gc.C) {
+	store := blobstore.New(s.Session.DB("a-database"), "prefix")
+
+	data := []byte(`some file data hashed with a different algorithm`)
+	sum := sha512.Sum512_256(data)
+	digest := fmt.Sprintf("sha512-256:%x", sum)
+
+	exists, err := store.Create(digest, bytes.NewReader(data))
+	c.Assert(err, gc.IsNil)
+	c.Assert(exists, gc.Equals, false)
+
+	f, err := store.Open(digest)
+	c.Assert(err, gc.IsNil)
+	defer f.Close()
+	gotData, err := ioutil.ReadAll(f)
+	c.Assert(err, gc.IsNil)
+	c.Assert(gotData, gc.DeepEquals, data)
+
+	ok, size, err := store.Check(digest)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(size, gc.Equals, int64(len(data)))
+
+	c.Assert(store.Remove(digest), gc.IsNil)
+	_, err = store.Open(digest)
+	c.Assert(err, gc.Equals, blobstore.ErrNotFound)
+}
+
+func (s *storeSuite) TestCreateUnsupportedAlgorithm(c *gc.C) {
+	store := blobstore.New(s.Session.DB("a-database"), "prefix")
+
+	data := []byte(`some file data`)
+	exists, err := store.Create("md5:deadbeef", bytes.NewReader(data))
+	c.Assert(err, gc.ErrorMatches, `unsupported hash algorithm "md5"`)
+	c.Assert(exists, gc.Equals, false)
+}
+
+func (s *storeSuite) TestCreateExplicitSHA256Digest(c *gc.C) {
+	store := blobstore.New(s.Session.DB("a-database"), "prefix")
+
+	data := []byte(`some file data`)
+	digest := "sha256:" + hashOf(data)
+
+	exists, err := store.Create(digest, bytes.NewReader(data))
+	c.Assert(err, gc.IsNil)
+	c.Assert(exists, gc.Equals, false)
+
+	// The bare-hex deprecated form addresses the same blob.
+	exists, err = store.Create(hashOf(data), bytes.NewReader(data))
+	c.Assert(err, gc.IsNil)
+	c.Assert(exists, gc.Equals, true)
+}
@@ -0,0 +1,314 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"math/big"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// ErrCorruptBlob is returned by EncryptedStorage.Open's reader
+// when a blob read sequentially from the start doesn't hash to
+// the plaintext hash it was stored under.
+var ErrCorruptBlob = fmt.Errorf("corrupt blob: plaintext hash mismatch")
+
+func encName(h string) string {
+	return "enc-" + h
+}
+
+// encMeta is the sidecar document recording how to decrypt and
+// locate the ciphertext for a blob addressed by its plaintext
+// hash. HMAC is reserved for callers that want to pair AES-CTR
+// with their own authentication; it isn't used by this package.
+type encMeta struct {
+	RefCount  int
+	CipherRef string
+	IV        []byte
+	Algorithm string
+	HMAC      []byte
+}
+
+// EncryptedStorage wraps a Storage so that blobs are addressed,
+// deduplicated and reference-counted by the SHA-256 hash of
+// their plaintext, but held on disk encrypted with AES-CTR
+// under a caller-supplied key, so that a database administrator
+// with access to the underlying Storage cannot read their
+// content. Because a fresh random IV is used for every Create,
+// encrypting the same plaintext twice produces different
+// ciphertext, so deduplication happens at the plaintext-hash
+// level, in EncryptedStorage's own sidecar collection, rather
+// than in the wrapped Storage.
+type EncryptedStorage struct {
+	store   *Storage
+	sidecar *mgo.Collection
+}
+
+// NewEncrypted returns a new EncryptedStorage that stores its
+// ciphertext in the given database, using the given collection
+// prefix for both the wrapped Storage and a sidecar collection
+// holding the plaintext-hash to ciphertext mapping.
+func NewEncrypted(db *mgo.Database, collectionPrefix string) *EncryptedStorage {
+	sidecar := db.C(collectionPrefix + ".enc")
+	// TODO check error
+	sidecar.EnsureIndex(mgo.Index{
+		Key:    []string{"filename"},
+		Unique: true,
+	})
+	return &EncryptedStorage{
+		store:   New(db, collectionPrefix),
+		sidecar: sidecar,
+	}
+}
+
+// Create encrypts the content read from r under key and stores
+// it, addressed by sha256Hash, the SHA-256 hash of the
+// plaintext. As with Storage.Create, if a blob with the same
+// plaintext hash already exists, its reference count is
+// incremented and alreadyExists is true; the key isn't used in
+// that case, since the existing ciphertext isn't touched.
+func (es *EncryptedStorage) Create(key []byte, sha256Hash string, r io.Reader) (alreadyExists bool, err error) {
+	sidecarRef := encName(sha256Hash)
+	if err := es.incSidecarRefCount(sidecarRef); err == nil {
+		return true, nil
+	} else if err != mgo.ErrNotFound {
+		return false, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return false, fmt.Errorf("cannot create cipher: %v", err)
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return false, err
+	}
+	stream := cipher.NewCTR(block, iv)
+
+	// Encrypt the whole blob into memory so that we know the
+	// ciphertext's hash, and hence its storage name, before we
+	// write it anywhere.
+	var cipherBuf bytes.Buffer
+	cipherHasher := sha256.New()
+	sw := &cipher.StreamWriter{S: stream, W: io.MultiWriter(&cipherBuf, cipherHasher)}
+
+	plainHasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(sw, plainHasher), r); err != nil {
+		return false, err
+	}
+	if actual := fmt.Sprintf("%x", plainHasher.Sum(nil)); actual != sha256Hash {
+		return false, fmt.Errorf("file checksum mismatch")
+	}
+	cipherHash := fmt.Sprintf("%x", cipherHasher.Sum(nil))
+
+	if _, err := es.store.Create(cipherHash, bytes.NewReader(cipherBuf.Bytes())); err != nil {
+		return false, fmt.Errorf("cannot store encrypted content: %v", err)
+	}
+
+	err = es.sidecar.Insert(bson.D{
+		{"filename", sidecarRef},
+		{"metadata", encMeta{
+			RefCount:  1,
+			CipherRef: cipherHash,
+			IV:        iv,
+			Algorithm: "aes-ctr",
+		}},
+	})
+	if err == nil {
+		return false, nil
+	}
+	if !mgo.IsDup(err) {
+		return false, err
+	}
+	// Someone else created the same plaintext blob first.
+	if err := es.incSidecarRefCount(sidecarRef); err != nil {
+		return false, fmt.Errorf("cannot increment blob ref count: %v", err)
+	}
+	if err := es.store.Remove(cipherHash); err != nil {
+		log.Printf("cannot remove redundant encrypted copy: %v", err)
+	}
+	return false, nil
+}
+
+func (es *EncryptedStorage) incSidecarRefCount(sidecarRef string) error {
+	return es.sidecar.Update(
+		bson.D{{"filename", sidecarRef}},
+		bson.D{{"$inc", bson.D{{"metadata.refcount", 1}}}},
+	)
+}
+
+// Check reports whether a blob with the given plaintext hash
+// currently exists in the storage.
+func (es *EncryptedStorage) Check(sha256Hash string) (exists bool, size int64, err error) {
+	var doc struct {
+		Metadata encMeta
+	}
+	err = es.sidecar.Find(bson.D{{"filename", encName(sha256Hash)}}).One(&doc)
+	if err == mgo.ErrNotFound {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	_, size, err = es.store.Check(doc.Metadata.CipherRef)
+	return true, size, err
+}
+
+// Remove decrements the reference count of a blob and removes
+// its ciphertext if it is the last reference.
+func (es *EncryptedStorage) Remove(sha256Hash string) error {
+	sidecarRef := encName(sha256Hash)
+	change := mgo.Change{
+		Update:    bson.D{{"$inc", bson.D{{"metadata.refcount", -1}}}},
+		ReturnNew: true,
+	}
+	var doc struct {
+		Metadata encMeta
+	}
+	_, err := es.sidecar.Find(bson.D{{"filename", sidecarRef}}).Apply(change, &doc)
+	if err != nil {
+		return err
+	}
+	if doc.Metadata.RefCount != 0 {
+		return nil
+	}
+	err = es.sidecar.Remove(bson.D{{"filename", sidecarRef}, {"metadata.refcount", 0}})
+	if err == mgo.ErrNotFound {
+		// Someone else got there first.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return es.store.Remove(doc.Metadata.CipherRef)
+}
+
+// Open opens the blob with the given plaintext hash, decrypting
+// it under key as it is read. If the blob is read sequentially
+// from the start, the plaintext hash is verified once the
+// stream is exhausted, and ErrCorruptBlob is returned in place
+// of io.EOF on mismatch; Seeking gives up that guarantee, since
+// there's no longer a single pass over the whole plaintext to
+// check.
+func (es *EncryptedStorage) Open(key []byte, sha256Hash string) (ReadSeekCloser, error) {
+	var doc struct {
+		Metadata encMeta
+	}
+	err := es.sidecar.Find(bson.D{{"filename", encName(sha256Hash)}}).One(&doc)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create cipher: %v", err)
+	}
+	f, err := es.store.Open(doc.Metadata.CipherRef)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptingReader{
+		f:        f,
+		block:    block,
+		iv:       doc.Metadata.IV,
+		expected: sha256Hash,
+		hasher:   sha256.New(),
+		linear:   true,
+		streamAt: -1,
+	}, nil
+}
+
+// decryptingReader streams AES-CTR-decrypted content from an
+// underlying ReadSeekCloser of ciphertext, re-deriving the
+// keystream at the right block boundary whenever the read
+// position jumps, since CTR mode allows the keystream for any
+// block to be computed independently of the ones before it.
+type decryptingReader struct {
+	f     ReadSeekCloser
+	block cipher.Block
+	iv    []byte
+	pos   int64
+
+	stream   cipher.Stream
+	streamAt int64
+
+	expected string
+	hasher   hash.Hash
+	linear   bool
+	verified bool
+}
+
+func (r *decryptingReader) alignTo(pos int64) error {
+	blockSize := int64(r.block.BlockSize())
+	blockIndex := pos / blockSize
+	within := int(pos % blockSize)
+
+	r.stream = cipher.NewCTR(r.block, ivAtBlock(r.iv, blockIndex))
+	if within > 0 {
+		discard := make([]byte, within)
+		r.stream.XORKeyStream(discard, discard)
+	}
+	if _, err := r.f.Seek(pos, io.SeekStart); err != nil {
+		return err
+	}
+	r.streamAt = pos
+	return nil
+}
+
+// ivAtBlock returns the IV to use so that the resulting
+// keystream starts at the given block index, treating iv as a
+// big-endian counter as CTR mode does.
+func ivAtBlock(iv []byte, blockIndex int64) []byte {
+	counter := new(big.Int).SetBytes(iv)
+	counter.Add(counter, big.NewInt(blockIndex))
+	out := counter.Bytes()
+	result := make([]byte, len(iv))
+	copy(result[len(result)-len(out):], out)
+	return result
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	if r.stream == nil || r.streamAt != r.pos {
+		if err := r.alignTo(r.pos); err != nil {
+			return 0, err
+		}
+	}
+	buf := make([]byte, len(p))
+	n, err := r.f.Read(buf)
+	if n > 0 {
+		r.stream.XORKeyStream(p[:n], buf[:n])
+		r.streamAt += int64(n)
+		r.pos += int64(n)
+		if r.linear {
+			r.hasher.Write(p[:n])
+		}
+	}
+	if err == io.EOF && r.linear && !r.verified {
+		r.verified = true
+		if actual := fmt.Sprintf("%x", r.hasher.Sum(nil)); actual != r.expected {
+			return n, ErrCorruptBlob
+		}
+	}
+	return n, err
+}
+
+func (r *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	r.linear = false
+	newPos, err := r.f.Seek(offset, whence)
+	if err != nil {
+		return 0, err
+	}
+	r.pos = newPos
+	return newPos, nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.f.Close()
+}
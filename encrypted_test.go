@@ -0,0 +1,135 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"github.com/juju/testing"
+	"github.com/rogpeppe/blobstore"
+	gc "launchpad.net/gocheck"
+)
+
+type encryptedSuite struct {
+	testing.MgoSuite
+}
+
+var _ = gc.Suite(&encryptedSuite{})
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")[:32]
+
+func (s *encryptedSuite) TestCreateOpenCheck(c *gc.C) {
+	store := blobstore.NewEncrypted(s.Session.DB("a-database"), "prefix")
+
+	data := []byte(`some secret file data`)
+	hash := hashOf(data)
+
+	exists, err := store.Create(testKey, hash, bytes.NewReader(data))
+	c.Assert(err, gc.IsNil)
+	c.Assert(exists, gc.Equals, false)
+
+	f, err := store.Open(testKey, hash)
+	c.Assert(err, gc.IsNil)
+	defer f.Close()
+	gotData, err := ioutil.ReadAll(f)
+	c.Assert(err, gc.IsNil)
+	c.Assert(gotData, gc.DeepEquals, data)
+
+	ok, size, err := store.Check(hash)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(size, gc.Equals, int64(len(data)))
+
+	ok, _, err = store.Check(hashOf([]byte("not stored")))
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, false)
+}
+
+func (s *encryptedSuite) TestCreateDeduplicatesByPlaintextHash(c *gc.C) {
+	// Blobs are deduplicated by plaintext hash, so storing the
+	// same plaintext twice reuses the existing ciphertext.
+	store := blobstore.NewEncrypted(s.Session.DB("a-database"), "prefix1")
+
+	data := []byte(`some secret file data`)
+	hash := hashOf(data)
+
+	exists, err := store.Create(testKey, hash, bytes.NewReader(data))
+	c.Assert(err, gc.IsNil)
+	c.Assert(exists, gc.Equals, false)
+
+	// A second Create with the same plaintext hash is recognised
+	// as a duplicate and doesn't need the key at all.
+	exists, err = store.Create(nil, hash, bytes.NewReader(data))
+	c.Assert(err, gc.IsNil)
+	c.Assert(exists, gc.Equals, true)
+}
+
+func (s *encryptedSuite) TestWrongKeyCorrupts(c *gc.C) {
+	store := blobstore.NewEncrypted(s.Session.DB("a-database"), "prefix")
+
+	data := []byte(`some secret file data, long enough to span a couple of AES blocks`)
+	hash := hashOf(data)
+
+	_, err := store.Create(testKey, hash, bytes.NewReader(data))
+	c.Assert(err, gc.IsNil)
+
+	wrongKey := append([]byte(nil), testKey...)
+	wrongKey[0] ^= 0xff
+
+	f, err := store.Open(wrongKey, hash)
+	c.Assert(err, gc.IsNil)
+	defer f.Close()
+	_, err = ioutil.ReadAll(f)
+	c.Assert(err, gc.Equals, blobstore.ErrCorruptBlob)
+}
+
+func (s *encryptedSuite) TestSeek(c *gc.C) {
+	store := blobstore.NewEncrypted(s.Session.DB("a-database"), "prefix")
+
+	data := make([]byte, 100*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	hash := hashOf(data)
+
+	_, err := store.Create(testKey, hash, bytes.NewReader(data))
+	c.Assert(err, gc.IsNil)
+
+	f, err := store.Open(testKey, hash)
+	c.Assert(err, gc.IsNil)
+	defer f.Close()
+
+	off, err := f.Seek(50*1024, io.SeekStart)
+	c.Assert(err, gc.IsNil)
+	c.Assert(off, gc.Equals, int64(50*1024))
+
+	got := make([]byte, 1024)
+	_, err = io.ReadFull(f, got)
+	c.Assert(err, gc.IsNil)
+	c.Assert(got, gc.DeepEquals, data[50*1024:51*1024])
+}
+
+func (s *encryptedSuite) TestRemove(c *gc.C) {
+	store := blobstore.NewEncrypted(s.Session.DB("a-database"), "prefix")
+
+	data := []byte(`some secret file data`)
+	hash := hashOf(data)
+
+	_, err := store.Create(testKey, hash, bytes.NewReader(data))
+	c.Assert(err, gc.IsNil)
+	_, err = store.Create(nil, hash, bytes.NewReader(data))
+	c.Assert(err, gc.IsNil)
+
+	c.Assert(store.Remove(hash), gc.IsNil)
+	ok, _, err := store.Check(hash)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+
+	c.Assert(store.Remove(hash), gc.IsNil)
+	ok, _, err = store.Check(hash)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, false)
+
+	_, err = store.Open(testKey, hash)
+	c.Assert(err, gc.NotNil)
+}
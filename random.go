@@ -0,0 +1,296 @@
+package blobstore
+
+import (
+	"fmt"
+	"io"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// byteRange describes a half-open range of bytes, [Start, End),
+// that has been written to a random-access upload.
+type byteRange struct {
+	Start int64
+	End   int64
+}
+
+// randomUploadDoc is the document held in Storage.uploads for
+// an upload created with CreateAt. Ranges holds the merged,
+// non-overlapping set of byte ranges written so far, so that
+// Commit can cheaply check the whole blob has been covered.
+type randomUploadDoc struct {
+	Id           bson.ObjectId `bson:"_id"`
+	ExpectedHash string
+	TotalSize    int64
+	Ranges       []byteRange
+}
+
+// RandomAccessBlobWriter allows a blob of known total size to
+// be uploaded as a series of writes at arbitrary, non-
+// overlapping offsets, so that a downloader fetching ranges out
+// of order (for example from a slow or parallel backend) can
+// write each one directly into position without buffering the
+// whole blob. It can be resumed after an interruption by
+// calling Storage.OpenAt with the UploadID.
+type RandomAccessBlobWriter interface {
+	// WriteAt writes len(p) bytes starting at offset off. The
+	// range [off, off+len(p)) must not overlap a range written
+	// by an earlier call.
+	WriteAt(p []byte, off int64) (n int, err error)
+
+	// UploadID returns the identifier that can later be passed
+	// to Storage.OpenAt to continue this upload.
+	UploadID() string
+
+	// Commit checks that every byte of the blob has been
+	// written and that it hashes to the expected value, then
+	// makes it available to Open under that hash, merging with
+	// an existing blob via the usual reference-counting path if
+	// one already exists. The writer must not be used again
+	// afterwards.
+	Commit() error
+
+	// Abort discards the provisional content. The writer must
+	// not be used again afterwards.
+	Abort() error
+}
+
+type randomWriter struct {
+	s         *Storage
+	id        bson.ObjectId
+	expected  string
+	totalSize int64
+	done      bool
+}
+
+// CreateAt returns a RandomAccessBlobWriter for uploading a
+// blob of totalSize bytes, with the given expected sha256 hash,
+// via writes at arbitrary offsets in any order.
+func (s *Storage) CreateAt(sha256Hash string, totalSize int64) (RandomAccessBlobWriter, error) {
+	if s.fs == nil {
+		return nil, fmt.Errorf("random-access uploads require a Mongo-backed Storage")
+	}
+	id := bson.NewObjectId()
+	err := s.uploads.Insert(randomUploadDoc{
+		Id:           id,
+		ExpectedHash: sha256Hash,
+		TotalSize:    totalSize,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot create upload: %v", err)
+	}
+	return &randomWriter{s: s, id: id, expected: sha256Hash, totalSize: totalSize}, nil
+}
+
+// OpenAt reopens the upload with the given ID, previously
+// returned by RandomAccessBlobWriter.UploadID, so that writing
+// can continue.
+func (s *Storage) OpenAt(uploadID string) (RandomAccessBlobWriter, error) {
+	if s.fs == nil {
+		return nil, fmt.Errorf("random-access uploads require a Mongo-backed Storage")
+	}
+	if !bson.IsObjectIdHex(uploadID) {
+		return nil, fmt.Errorf("invalid upload id %q", uploadID)
+	}
+	id := bson.ObjectIdHex(uploadID)
+	var doc randomUploadDoc
+	if err := s.uploads.FindId(id).One(&doc); err != nil {
+		return nil, err
+	}
+	return &randomWriter{s: s, id: id, expected: doc.ExpectedHash, totalSize: doc.TotalSize}, nil
+}
+
+func (w *randomWriter) UploadID() string {
+	return w.id.Hex()
+}
+
+func (w *randomWriter) WriteAt(p []byte, off int64) (int, error) {
+	if w.done {
+		return 0, fmt.Errorf("write to finalized upload")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if off < 0 || off+int64(len(p)) > w.totalSize {
+		return 0, fmt.Errorf("write out of bounds")
+	}
+	add := byteRange{off, off + int64(len(p))}
+	data := append([]byte(nil), p...)
+
+	// Record the new range in the upload's merged range list.
+	// Two concurrent WriteAt calls for disjoint ranges could both
+	// read the same Ranges and each compute a merge missing the
+	// other's range, so the update is conditioned on Ranges still
+	// matching what we read; if a concurrent write gets there
+	// first, we reread and try again rather than clobbering it.
+	// The overlap check and the data upsert both happen only once
+	// we hold a Ranges value we're about to condition the update
+	// on, so a write rejected for overlapping never leaves an
+	// orphan row in s.ranges for Commit to splice in later.
+	for {
+		var doc randomUploadDoc
+		if err := w.s.uploads.FindId(w.id).One(&doc); err != nil {
+			return 0, err
+		}
+		for _, r := range doc.Ranges {
+			if add.Start < r.End && add.End > r.Start {
+				return 0, fmt.Errorf("write at [%d, %d) overlaps a previously written range", add.Start, add.End)
+			}
+		}
+		_, err := w.s.ranges.Upsert(
+			bson.D{{"uploadid", w.id}, {"start", off}},
+			bson.D{{"$set", bson.D{
+				{"uploadid", w.id},
+				{"start", off},
+				{"end", add.End},
+				{"data", data},
+			}}},
+		)
+		if err != nil {
+			return 0, err
+		}
+		newRanges := mergeRange(doc.Ranges, add)
+		err = w.s.uploads.Update(
+			bson.D{{"_id", w.id}, {"ranges", doc.Ranges}},
+			bson.D{{"$set", bson.D{{"ranges", newRanges}}}},
+		)
+		if err == nil {
+			return len(p), nil
+		}
+		if err != mgo.ErrNotFound {
+			return 0, err
+		}
+		// Someone else updated Ranges between our read and our
+		// write; reread the current state and try again.
+	}
+}
+
+// mergeRange inserts add into the sorted, non-overlapping
+// ranges, merging it with any ranges it touches. Callers must
+// ensure add does not overlap an existing range.
+func mergeRange(ranges []byteRange, add byteRange) []byteRange {
+	i := 0
+	for i < len(ranges) && ranges[i].Start < add.Start {
+		i++
+	}
+	all := make([]byteRange, 0, len(ranges)+1)
+	all = append(all, ranges[:i]...)
+	all = append(all, add)
+	all = append(all, ranges[i:]...)
+
+	merged := all[:1]
+	for _, r := range all[1:] {
+		last := &merged[len(merged)-1]
+		if r.Start <= last.End {
+			if r.End > last.End {
+				last.End = r.End
+			}
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	return merged
+}
+
+// coversFully reports whether ranges, which must be sorted and
+// non-overlapping, cover the whole of [0, totalSize).
+func coversFully(ranges []byteRange, totalSize int64) bool {
+	return len(ranges) == 1 && ranges[0].Start == 0 && ranges[0].End == totalSize
+}
+
+func (w *randomWriter) Commit() error {
+	if w.done {
+		return fmt.Errorf("commit of finalized upload")
+	}
+	var doc randomUploadDoc
+	if err := w.s.uploads.FindId(w.id).One(&doc); err != nil {
+		return err
+	}
+	if !coversFully(doc.Ranges, w.totalSize) {
+		return fmt.Errorf("upload incomplete: missing byte ranges")
+	}
+	w.done = true
+
+	blobRef := hashName(Digest{Algorithm: "sha256", Hex: w.expected})
+	if err := w.s.refs.Increment(blobRef); err == nil {
+		return w.s.removeRandomUpload(w.id)
+	} else if err != mgo.ErrNotFound {
+		return err
+	}
+
+	iter := w.s.ranges.Find(bson.D{{"uploadid", w.id}}).Sort("start").Iter()
+	f, err := w.s.fs.Create(blobRef)
+	if err != nil {
+		iter.Close()
+		return err
+	}
+	f.SetMeta(refCountMeta{RefCount: 1})
+	f.SetName(blobRef)
+	copyErr := copyAndCheckHash(f, &rangeSeqReader{iter: iter}, Digest{Algorithm: "sha256", Hex: w.expected})
+	if closeErr := iter.Close(); copyErr == nil {
+		copyErr = closeErr
+	}
+	if copyErr != nil {
+		f.Abort()
+		f.Close()
+		return copyErr
+	}
+
+	err = f.Close()
+	if err == nil {
+		return w.s.removeRandomUpload(w.id)
+	}
+	if !mgo.IsDup(err) {
+		return err
+	}
+	// Someone else committed the same blob first.
+	if err := w.s.refs.Increment(blobRef); err != nil {
+		return fmt.Errorf("cannot increment blob ref count: %v", err)
+	}
+	return w.s.removeRandomUpload(w.id)
+}
+
+func (w *randomWriter) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	return w.s.removeRandomUpload(w.id)
+}
+
+func (s *Storage) removeRandomUpload(id bson.ObjectId) error {
+	if _, err := s.ranges.RemoveAll(bson.D{{"uploadid", id}}); err != nil {
+		return err
+	}
+	if err := s.uploads.RemoveId(id); err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// rangeSeqReader reads the contiguous byte ranges produced by
+// iterating over an upload's range documents sorted by offset,
+// presenting them as a single stream.
+type rangeSeqReader struct {
+	iter *mgo.Iter
+	cur  []byte
+}
+
+func (r *rangeSeqReader) Read(p []byte) (int, error) {
+	for len(r.cur) == 0 {
+		var doc struct {
+			Data []byte
+		}
+		if !r.iter.Next(&doc) {
+			if err := r.iter.Err(); err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		r.cur = doc.Data
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
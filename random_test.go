@@ -0,0 +1,102 @@
+package blobstore_test
+
+import (
+	"github.com/rogpeppe/blobstore"
+	"labix.org/v2/mgo"
+	gc "launchpad.net/gocheck"
+)
+
+func (s *storeSuite) TestCreateAtOutOfOrderWrites(c *gc.C) {
+	store := blobstore.New(s.Session.DB("a-database"), "prefix")
+
+	data := []byte(`some file data, written out of order`)
+	hash := hashOf(data)
+	split := len(data) / 2
+
+	w, err := store.CreateAt(hash, int64(len(data)))
+	c.Assert(err, gc.IsNil)
+
+	n, err := w.WriteAt(data[split:], int64(split))
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, len(data)-split)
+
+	n, err = w.WriteAt(data[:split], 0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, split)
+
+	c.Assert(w.Commit(), gc.IsNil)
+
+	assertBlob(c, store, hash)
+}
+
+func (s *storeSuite) TestCreateAtResume(c *gc.C) {
+	store := blobstore.New(s.Session.DB("a-database"), "prefix")
+
+	data := []byte(`some more file data, resumed across sessions`)
+	hash := hashOf(data)
+	split := len(data) / 2
+
+	w, err := store.CreateAt(hash, int64(len(data)))
+	c.Assert(err, gc.IsNil)
+	_, err = w.WriteAt(data[:split], 0)
+	c.Assert(err, gc.IsNil)
+	uploadID := w.UploadID()
+
+	w2, err := store.OpenAt(uploadID)
+	c.Assert(err, gc.IsNil)
+	_, err = w2.WriteAt(data[split:], int64(split))
+	c.Assert(err, gc.IsNil)
+	c.Assert(w2.Commit(), gc.IsNil)
+
+	assertBlob(c, store, hash)
+}
+
+func (s *storeSuite) TestCreateAtOverlappingWriteRejected(c *gc.C) {
+	store := blobstore.New(s.Session.DB("a-database"), "prefix")
+
+	data := []byte(`some file data`)
+	hash := hashOf(data)
+
+	w, err := store.CreateAt(hash, int64(len(data)))
+	c.Assert(err, gc.IsNil)
+	_, err = w.WriteAt(data[:8], 0)
+	c.Assert(err, gc.IsNil)
+
+	_, err = w.WriteAt(data[4:12], 4)
+	c.Assert(err, gc.ErrorMatches, "write at .* overlaps a previously written range")
+}
+
+func (s *storeSuite) TestCreateAtCommitIncomplete(c *gc.C) {
+	store := blobstore.New(s.Session.DB("a-database"), "prefix")
+
+	data := []byte(`some file data`)
+	hash := hashOf(data)
+
+	w, err := store.CreateAt(hash, int64(len(data)))
+	c.Assert(err, gc.IsNil)
+	_, err = w.WriteAt(data[:4], 0)
+	c.Assert(err, gc.IsNil)
+
+	c.Assert(w.Commit(), gc.ErrorMatches, "upload incomplete: missing byte ranges")
+
+	f, err := store.Open(hash)
+	c.Assert(err, gc.Equals, mgo.ErrNotFound)
+	c.Assert(f, gc.IsNil)
+}
+
+func (s *storeSuite) TestCreateAtAbort(c *gc.C) {
+	store := blobstore.New(s.Session.DB("a-database"), "prefix")
+
+	data := []byte(`some file data`)
+	hash := hashOf(data)
+
+	w, err := store.CreateAt(hash, int64(len(data)))
+	c.Assert(err, gc.IsNil)
+	_, err = w.WriteAt(data, 0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(w.Abort(), gc.IsNil)
+
+	f, err := store.Open(hash)
+	c.Assert(err, gc.Equals, mgo.ErrNotFound)
+	c.Assert(f, gc.IsNil)
+}
@@ -1,187 +1,254 @@
-// The blobstore package implements a blob storage
-// system layered on top of MongoDB's GridFS.
-// Blobs with the same content share storage.
+// The blobstore package implements a blob storage system with
+// hash-addressed, reference-counted blobs. Blobs with the same
+// content share storage. Content is held behind a pluggable
+// BlobBackend and RefCountStore pair; New uses MongoDB's GridFS
+// for both, but NewWithBackend allows other storage systems to
+// be used instead.
 package blobstore
 
 import (
-	"crypto/sha256"
 	"fmt"
 	"io"
 	"log"
 
 	"labix.org/v2/mgo"
-	"labix.org/v2/mgo/bson"
 )
 
-// Storage represents a collection of named blobs held in a mongo
-// database.
+// Storage represents a collection of named, hash-addressed
+// blobs.
 type Storage struct {
-	fs *mgo.GridFS
+	backend BlobBackend
+	refs    RefCountStore
+
+	// fs, manifests, uploads and ranges are only set when the
+	// Storage was created with New, and back the chunked,
+	// resumable and random-access upload features, which are
+	// currently Mongo-specific extensions layered on top of the
+	// backend-agnostic core.
+	fs        *mgo.GridFS
+	manifests *mgo.Collection
+	uploads   *mgo.Collection
+	ranges    *mgo.Collection
+	chunked   bool
+}
+
+// Option configures a Storage returned by New or NewWithBackend.
+type Option func(*Storage)
+
+// Chunked enables content-defined chunking. When set, Create
+// splits the incoming reader into variable-sized chunks that
+// are stored and deduplicated individually, rather than as a
+// single blob, so that blobs sharing internal content (such as
+// VM images or tarballs with common files) share storage even
+// when their overall content differs. It does not affect Open,
+// Check or Remove, which handle chunked blobs regardless of
+// this setting. Chunked mode requires a Mongo-backed Storage
+// created with New.
+func Chunked() Option {
+	return func(s *Storage) {
+		s.chunked = true
+	}
 }
 
 // New returns a new Storage that stores blobs in the
-// given database. The collections created will be given names with the
-// given prefix.
-func New(db *mgo.Database, collectionPrefix string) *Storage {
+// given database, using GridFS as the backend. The collections
+// created will be given names with the given prefix.
+func New(db *mgo.Database, collectionPrefix string, opts ...Option) *Storage {
+	fs := db.GridFS(collectionPrefix)
 	s := &Storage{
-		fs: db.GridFS(collectionPrefix),
+		backend:   newGridFSBackend(fs),
+		refs:      &gridFSRefCountStore{fs: fs},
+		fs:        fs,
+		manifests: db.C(collectionPrefix + ".manifests"),
+		uploads:   db.C(collectionPrefix + ".uploads"),
+		ranges:    db.C(collectionPrefix + ".ranges"),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
 	// TODO check error
 	s.fs.Files.EnsureIndex(mgo.Index{
 		Key:    []string{"filename"},
 		Unique: true,
 	})
+	s.manifests.EnsureIndex(mgo.Index{
+		Key:    []string{"filename"},
+		Unique: true,
+	})
+	s.ranges.EnsureIndex(mgo.Index{
+		Key: []string{"uploadid", "start"},
+	})
 	return s
 }
 
-func hashName(h string) string {
-	return "blob-" + h
+// NewWithBackend returns a new Storage that stores blobs using
+// the given backend and reference-count store instead of
+// Mongo's GridFS. Chunked mode, CreateWriter and CreateAt are
+// Mongo-specific extensions and return an error when used on a
+// Storage created this way.
+func NewWithBackend(backend BlobBackend, refs RefCountStore, opts ...Option) *Storage {
+	s := &Storage{backend: backend, refs: refs}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// hashName returns the backend key under which a blob with the
+// given digest is stored. A SHA-256 digest keeps the plain
+// "blob-<hex>" name used by every version of this package, for
+// backward compatibility with existing data; other algorithms
+// are disambiguated with their algorithm name, since two
+// algorithms could otherwise coincidentally agree on a hex
+// value.
+func hashName(d Digest) string {
+	if d.Algorithm == "sha256" {
+		return "blob-" + d.Hex
+	}
+	return "blob-" + d.Algorithm + "-" + d.Hex
 }
 
 type refCountMeta struct {
 	RefCount int
 }
 
-// Check reports whether a blob with the given hash currently
-// exists in the storage.
-func (s *Storage) Check(sha256Hash string) (exists bool, size int64, err error) {
-	f, err := s.fs.Open(hashName(sha256Hash))
-	if err != nil && err != mgo.ErrNotFound {
+// Check reports whether a blob with the given digest currently
+// exists in the storage. For backward compatibility, digest may
+// be a bare hex-encoded SHA-256 hash instead of an
+// "algorithm:hex" string; see ParseDigest.
+func (s *Storage) Check(digest string) (exists bool, size int64, err error) {
+	d, err := ParseDigest(digest)
+	if err != nil {
 		return false, 0, err
 	}
+	size, err = s.backend.StatSize(hashName(d))
 	if err == nil {
-		size := f.Size()
-		f.Close()
 		return true, size, nil
 	}
-	return false, 0, nil
+	if err != ErrNotFound {
+		return false, 0, err
+	}
+	if d.Algorithm != "sha256" {
+		return false, 0, nil
+	}
+	return s.checkManifest(d.Hex)
 }
 
-// Create creates a blob with the given name, reading
-// the contents from the given reader. The sha256Hash
-// parameter holds the sha256 hash of the blob's contents,
-// encoded as ASCII hexadecimal.
+// Create creates a blob with the given name, reading the
+// contents from the given reader. The digest parameter holds
+// the hash of the blob's contents, as an "algorithm:hex" string.
+// The algorithms understood are sha256 and sha512-256, plus any
+// added with RegisterHash; see ParseDigest for the deprecated
+// bare-hex form still accepted for SHA-256.
 //
 // If a blob with the same content already exists in the store,
 // that content will be reused, its reference count
 // incremented, and alreadyExists will be true.
 // No data will have been read from r in this case.
-func (s *Storage) Create(sha256Hash string, r io.Reader) (alreadyExists bool, err error) {
-	blobRef := hashName(sha256Hash)
+func (s *Storage) Create(digest string, r io.Reader) (alreadyExists bool, err error) {
+	d, err := ParseDigest(digest)
+	if err != nil {
+		return false, err
+	}
+	if s.chunked {
+		if d.Algorithm != "sha256" {
+			return false, fmt.Errorf("chunked mode only supports sha256 digests")
+		}
+		return s.createChunked(d.Hex, r)
+	}
+	return s.createPlain(d, r)
+}
 
-	// First try to increment the file's reference count.
-	err = s.incRefCount(blobRef)
+// createPlain stores a single blob via the backend, without
+// going through chunked mode, regardless of whether s.chunked is
+// set. createChunked calls this directly, rather than s.Create,
+// to store each of its content-defined chunks as an ordinary
+// blob; calling s.Create there would route back into
+// createChunked and recurse into the chunk's own bytes forever.
+func (s *Storage) createPlain(d Digest, r io.Reader) (alreadyExists bool, err error) {
+	blobRef := hashName(d)
+
+	// First try to increment the blob's reference count.
+	err = s.refs.Increment(blobRef)
 	if err == nil {
 		return true, nil
 	}
-	if err != mgo.ErrNotFound {
+	if err != ErrNotFound {
 		return false, err
 	}
-	f, err := s.fs.Create(blobRef)
+	w, err := s.backend.CreateWriter(blobRef)
 	if err != nil {
 		return false, err
 	}
-	f.SetMeta(refCountMeta{RefCount: 1})
-	f.SetName(blobRef)
-	if err := copyAndCheckHash(f, r, sha256Hash); err != nil {
-		// Remove any chunks that were written while we were checking the hash.
-		f.Abort()
-		if closeErr := f.Close(); closeErr != nil {
-			// TODO add mgo.ErrAborted so that we can avoid a string error check.
-			if closeErr.Error() != "write aborted" {
-				log.Printf("cannot clean up after hash-mismatch file write: %v", closeErr)
-			}
+	if err := copyAndCheckHash(w, r, d); err != nil {
+		if abortErr := w.Abort(); abortErr != nil {
+			log.Printf("cannot clean up after hash-mismatch write: %v", abortErr)
 		}
 		return false, err
 	}
+	if err := w.Close(); err != nil {
+		return false, err
+	}
 
-	err = f.Close()
+	err = s.refs.Create(blobRef)
 	if err == nil {
 		return false, nil
 	}
-	if !mgo.IsDup(err) {
+	if err != ErrAlreadyExists {
 		return false, err
 	}
-	// We cannot close the file because of a clashing index,
-	// which means someone else has created the blob first,
-	// so all we need to do is increment the ref count.
-	err = s.incRefCount(blobRef)
-	if err == nil {
-		// Although technically, the content already exists,
-		// we have already read the content from the reader,
-		// so report alreadyExists=false.
-		return false, nil
-	}
-	if err != mgo.ErrNotFound {
+	// Someone else created the same blob first. Its content is
+	// identical to ours, so there's nothing left to do but
+	// count our reference to it.
+	if err := s.refs.Increment(blobRef); err != nil {
 		return false, fmt.Errorf("cannot increment blob ref count: %v", err)
 	}
-	// Unfortunately the other party has deleted the blob
-	// in between Close and incRefCount.
-	// The chunks we have written have already been
-	// deleted at this point, so there's nothing we
-	// can do except return an error. This situation
-	// should be vanishingly unlikely in practice as
-	// it relies on
-	// a) two simultaneous initial uploads of the same blob.
-	// b) one upload being removed immediately after upload.
-	// c) the removal happening in the exact window between
-	// f.Close and s.incRefCount.
-	return false, fmt.Errorf("duplicate blob removed at an inopportune moment")
-}
-
-func (s *Storage) incRefCount(blobRef string) error {
-	return s.fs.Files.Update(
-		bson.D{{"filename", blobRef}},
-		bson.D{{"$inc", bson.D{{"metadata.refcount", 1}}}},
-	)
+	return false, nil
 }
 
 // Remove decrements the reference count of a blob and
 // removes it if it is the last reference.
-func (s *Storage) Remove(sha256Hash string) error {
-	// The mgo gridfs interface does not allow us to atomically
-	// remove a file, so we go behind the scenes to rename
-	// the file if and only if the decremented reference count
-	// is zero.
-	blobRef := hashName(sha256Hash)
-	change := mgo.Change{
-		Update:    bson.D{{"$inc", bson.D{{"metadata.refcount", -1}}}},
-		ReturnNew: true,
-	}
-	var doc struct {
-		Metadata refCountMeta
-	}
-	_, err := s.fs.Files.Find(bson.D{{"filename", blobRef}}).Apply(change, &doc)
+func (s *Storage) Remove(digest string) error {
+	d, err := ParseDigest(digest)
 	if err != nil {
 		return err
 	}
-	if doc.Metadata.RefCount != 0 {
-		return nil
+	blobRef := hashName(d)
+	refCount, err := s.refs.Decrement(blobRef)
+	if err == ErrNotFound {
+		if d.Algorithm != "sha256" {
+			return ErrNotFound
+		}
+		return s.removeManifest(d.Hex)
+	}
+	if err != nil {
+		return err
 	}
-	// The ref count has just reached zero. Rename the file atomically,
-	// but only if the ref count has not been inremented in the meantime.
-	newName := "deleted-" + bson.NewObjectId().Hex()
-	err = s.fs.Files.Update(
-		bson.D{{"filename", blobRef}, {"metadata.refcount", 0}},
-		bson.D{{"$set", bson.D{{"filename", newName}}}},
-	)
-	if err == mgo.ErrNotFound {
-		// Someone else must have got there first.
+	if refCount != 0 {
 		return nil
 	}
+	removed, err := s.refs.Remove(blobRef)
 	if err != nil {
-		return fmt.Errorf("cannot rename file before deletion: %v", err)
+		return err
+	}
+	if !removed {
+		// Someone else incremented the count again before we
+		// could remove the record.
+		return nil
 	}
-	return s.fs.Remove(newName)
+	return s.backend.Remove(blobRef)
 }
 
-func copyAndCheckHash(w io.Writer, r io.Reader, sha256Hash string) error {
-	sha256hash := sha256.New()
-	if _, err := io.Copy(io.MultiWriter(w, sha256hash), r); err != nil {
+func copyAndCheckHash(w io.Writer, r io.Reader, d Digest) error {
+	hasher, err := newHasher(d.Algorithm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.MultiWriter(w, hasher), r); err != nil {
 		return err
 	}
-	actualHash := fmt.Sprintf("%x", sha256hash.Sum(nil))
-	if actualHash != sha256Hash {
+	actualHash := fmt.Sprintf("%x", hasher.Sum(nil))
+	if actualHash != d.Hex {
 		return fmt.Errorf("file checksum mismatch")
 	}
 	return nil
@@ -193,12 +260,24 @@ type ReadSeekCloser interface {
 	io.Closer
 }
 
-// Open opens the blob with the given hash.
-// It returns mgo.ErrNotFound if the blob is not there.
-func (s *Storage) Open(sha256hash string) (ReadSeekCloser, error) {
-	f, err := s.fs.Open(hashName(sha256hash))
+// Open opens the blob with the given digest. It returns
+// ErrNotFound if the blob is not there. For backward
+// compatibility, digest may be a bare hex-encoded SHA-256 hash
+// instead of an "algorithm:hex" string; see ParseDigest.
+func (s *Storage) Open(digest string) (ReadSeekCloser, error) {
+	d, err := ParseDigest(digest)
 	if err != nil {
 		return nil, err
 	}
-	return f, nil
+	f, err := s.backend.OpenReader(hashName(d))
+	if err == nil {
+		return f, nil
+	}
+	if err != ErrNotFound {
+		return nil, err
+	}
+	if d.Algorithm != "sha256" {
+		return nil, ErrNotFound
+	}
+	return s.openManifest(d.Hex)
 }
@@ -0,0 +1,284 @@
+package blobstore
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"fmt"
+	"hash"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// uploadChunkSize is the size of each chunk written to a
+// provisional upload file. It matches GridFS's usual default
+// chunk size so that a committed upload looks like any other
+// GridFS file.
+const uploadChunkSize = 255 * 1024
+
+func uploadName(id bson.ObjectId) string {
+	return "upload-" + id.Hex()
+}
+
+// uploadMeta is stored in a provisional upload file's metadata
+// so that the upload can be picked up again at the correct
+// offset, whether by the same process after a crash or by a
+// different one entirely.
+type uploadMeta struct {
+	ExpectedHash string
+	BytesWritten int64
+	HashState    []byte
+}
+
+// BlobWriter allows a blob's content to be uploaded over
+// multiple Write calls, potentially spanning separate HTTP
+// requests or processes, and resumed from where it left off by
+// calling Storage.ResumeWriter with the UploadID.
+type BlobWriter interface {
+	// Write appends p to the upload's provisional content.
+	Write(p []byte) (n int, err error)
+
+	// Size returns the number of bytes written so far.
+	Size() int64
+
+	// UploadID returns the identifier that can later be passed
+	// to Storage.ResumeWriter to continue this upload.
+	UploadID() string
+
+	// Commit verifies that the content written so far hashes to
+	// the expected value and makes it available to Open under
+	// that hash, merging with an existing blob via the usual
+	// reference-counting path if one already exists. The
+	// BlobWriter must not be used again afterwards.
+	Commit() error
+
+	// Cancel discards the provisional content. The BlobWriter
+	// must not be used again afterwards.
+	Cancel() error
+
+	// Close releases local resources held by the writer without
+	// finalizing or discarding the upload, so that it can be
+	// resumed later with ResumeWriter. It is not necessary to
+	// call Close after Commit or Cancel.
+	Close() error
+}
+
+type blobWriter struct {
+	s          *Storage
+	id         bson.ObjectId
+	expected   string
+	written    int64
+	chunkIndex int
+	pending    []byte
+	hasher     hash.Hash
+	done       bool
+}
+
+// CreateWriter returns a BlobWriter that can be used to upload
+// a blob with the given expected sha256 hash across one or more
+// Write calls. The upload is held in a provisional file until
+// Commit is called, so it can be resumed with ResumeWriter if
+// interrupted, and is not visible to Open until then. Cancel
+// removes the provisional file; an upload that is neither
+// committed nor cancelled stays in the database.
+func (s *Storage) CreateWriter(sha256Hash string) (BlobWriter, error) {
+	if s.fs == nil {
+		return nil, fmt.Errorf("resumable uploads require a Mongo-backed Storage")
+	}
+	id := bson.NewObjectId()
+	err := s.fs.Files.Insert(bson.D{
+		{"_id", id},
+		{"filename", uploadName(id)},
+		{"uploadDate", time.Now()},
+		{"length", 0},
+		{"chunkSize", uploadChunkSize},
+		{"metadata", uploadMeta{ExpectedHash: sha256Hash}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot create upload: %v", err)
+	}
+	return &blobWriter{
+		s:        s,
+		id:       id,
+		expected: sha256Hash,
+		hasher:   sha256.New(),
+	}, nil
+}
+
+// ResumeWriter reopens the upload with the given ID, previously
+// returned by BlobWriter.UploadID, so that writing can continue
+// at the offset it had reached when it was last used.
+func (s *Storage) ResumeWriter(uploadID string) (BlobWriter, error) {
+	if s.fs == nil {
+		return nil, fmt.Errorf("resumable uploads require a Mongo-backed Storage")
+	}
+	if !bson.IsObjectIdHex(uploadID) {
+		return nil, fmt.Errorf("invalid upload id %q", uploadID)
+	}
+	id := bson.ObjectIdHex(uploadID)
+	var doc struct {
+		Metadata uploadMeta
+	}
+	if err := s.fs.Files.FindId(id).One(&doc); err != nil {
+		return nil, err
+	}
+	w := &blobWriter{
+		s:          s,
+		id:         id,
+		expected:   doc.Metadata.ExpectedHash,
+		written:    doc.Metadata.BytesWritten,
+		chunkIndex: int(doc.Metadata.BytesWritten / uploadChunkSize),
+		hasher:     sha256.New(),
+	}
+	if len(doc.Metadata.HashState) > 0 {
+		unmarshaler, ok := w.hasher.(encoding.BinaryUnmarshaler)
+		if !ok {
+			return nil, fmt.Errorf("hash implementation does not support resuming")
+		}
+		if err := unmarshaler.UnmarshalBinary(doc.Metadata.HashState); err != nil {
+			return nil, fmt.Errorf("cannot restore upload hash state: %v", err)
+		}
+	}
+	if partial := doc.Metadata.BytesWritten % uploadChunkSize; partial != 0 {
+		var chunk struct {
+			Data []byte
+		}
+		err := s.fs.Chunks.Find(bson.D{{"files_id", id}, {"n", w.chunkIndex}}).One(&chunk)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load partial upload chunk: %v", err)
+		}
+		// flushPending saves the chunk on every Write, but
+		// BytesWritten/HashState are only saved once the whole
+		// Write call returns, so the stored chunk may hold bytes
+		// from a later, unacknowledged flush than the ones
+		// reflected in doc.Metadata. Trust only the prefix that
+		// BytesWritten accounts for; anything beyond it must be
+		// rewritten by the caller.
+		if len(chunk.Data) < partial {
+			return nil, fmt.Errorf("partial upload chunk shorter than recorded progress")
+		}
+		w.pending = append([]byte(nil), chunk.Data[:partial]...)
+	}
+	return w, nil
+}
+
+func (w *blobWriter) UploadID() string {
+	return w.id.Hex()
+}
+
+func (w *blobWriter) Size() int64 {
+	return w.written
+}
+
+func (w *blobWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, fmt.Errorf("write to finalized upload")
+	}
+	total := len(p)
+	for len(p) > 0 {
+		space := uploadChunkSize - len(w.pending)
+		n := len(p)
+		if n > space {
+			n = space
+		}
+		w.pending = append(w.pending, p[:n]...)
+		w.hasher.Write(p[:n])
+		w.written += int64(n)
+		p = p[n:]
+		if err := w.flushPending(); err != nil {
+			return total - len(p) - n, err
+		}
+		if len(w.pending) == uploadChunkSize {
+			w.chunkIndex++
+			w.pending = nil
+		}
+	}
+	if err := w.saveProgress(); err != nil {
+		return total, err
+	}
+	return total, nil
+}
+
+// flushPending durably stores the current (possibly partial)
+// chunk so that the upload can be resumed from it if the
+// process is interrupted before the next Write or Close.
+func (w *blobWriter) flushPending() error {
+	_, err := w.s.fs.Chunks.Upsert(
+		bson.D{{"files_id", w.id}, {"n", w.chunkIndex}},
+		bson.D{{"$set", bson.D{{"data", w.pending}}}},
+	)
+	return err
+}
+
+func (w *blobWriter) saveProgress() error {
+	update := bson.D{
+		{"length", w.written},
+		{"metadata.byteswritten", w.written},
+	}
+	if marshaler, ok := w.hasher.(encoding.BinaryMarshaler); ok {
+		if state, err := marshaler.MarshalBinary(); err == nil {
+			update = append(update, bson.DocElem{"metadata.hashstate", state})
+		}
+	}
+	return w.s.fs.Files.UpdateId(w.id, bson.D{{"$set", update}})
+}
+
+func (w *blobWriter) Commit() error {
+	if w.done {
+		return fmt.Errorf("commit of finalized upload")
+	}
+	w.done = true
+	actualHash := fmt.Sprintf("%x", w.hasher.Sum(nil))
+	if actualHash != w.expected {
+		return fmt.Errorf("file checksum mismatch")
+	}
+	blobRef := hashName(Digest{Algorithm: "sha256", Hex: w.expected})
+	if err := w.s.refs.Increment(blobRef); err == nil {
+		// The blob already exists; discard our provisional copy.
+		return w.s.removeUpload(w.id)
+	} else if err != mgo.ErrNotFound {
+		return err
+	}
+	err := w.s.fs.Files.UpdateId(w.id, bson.D{{"$set", bson.D{
+		{"filename", blobRef},
+		{"metadata", refCountMeta{RefCount: 1}},
+	}}})
+	if err == nil {
+		return nil
+	}
+	if !mgo.IsDup(err) {
+		return err
+	}
+	// Someone else committed the same blob first; increment its
+	// ref count and discard our provisional copy.
+	if err := w.s.refs.Increment(blobRef); err != nil {
+		return fmt.Errorf("cannot increment blob ref count: %v", err)
+	}
+	return w.s.removeUpload(w.id)
+}
+
+func (w *blobWriter) Cancel() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	return w.s.removeUpload(w.id)
+}
+
+func (w *blobWriter) Close() error {
+	w.done = true
+	return nil
+}
+
+// removeUpload deletes a provisional upload file and its
+// chunks.
+func (s *Storage) removeUpload(id bson.ObjectId) error {
+	if _, err := s.fs.Chunks.RemoveAll(bson.D{{"files_id", id}}); err != nil {
+		return err
+	}
+	if err := s.fs.Files.RemoveId(id); err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	return nil
+}
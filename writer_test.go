@@ -0,0 +1,82 @@
+package blobstore_test
+
+import (
+	"github.com/rogpeppe/blobstore"
+	"labix.org/v2/mgo"
+	gc "launchpad.net/gocheck"
+)
+
+func (s *storeSuite) TestCreateWriterSingleWrite(c *gc.C) {
+	store := blobstore.New(s.Session.DB("a-database"), "prefix")
+
+	data := []byte(`some file data`)
+	hash := hashOf(data)
+
+	w, err := store.CreateWriter(hash)
+	c.Assert(err, gc.IsNil)
+	n, err := w.Write(data)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, len(data))
+	c.Assert(w.Size(), gc.Equals, int64(len(data)))
+	c.Assert(w.Commit(), gc.IsNil)
+
+	assertBlob(c, store, hash)
+}
+
+func (s *storeSuite) TestCreateWriterResume(c *gc.C) {
+	store := blobstore.New(s.Session.DB("a-database"), "prefix")
+
+	data := []byte(`some file data, split across two sessions`)
+	hash := hashOf(data)
+	split := len(data) / 2
+
+	w, err := store.CreateWriter(hash)
+	c.Assert(err, gc.IsNil)
+	_, err = w.Write(data[:split])
+	c.Assert(err, gc.IsNil)
+	uploadID := w.UploadID()
+	c.Assert(w.Close(), gc.IsNil)
+
+	w2, err := store.ResumeWriter(uploadID)
+	c.Assert(err, gc.IsNil)
+	c.Assert(w2.Size(), gc.Equals, int64(split))
+	_, err = w2.Write(data[split:])
+	c.Assert(err, gc.IsNil)
+	c.Assert(w2.Commit(), gc.IsNil)
+
+	assertBlob(c, store, hash)
+}
+
+func (s *storeSuite) TestCreateWriterCancel(c *gc.C) {
+	store := blobstore.New(s.Session.DB("a-database"), "prefix")
+
+	data := []byte(`some file data`)
+	hash := hashOf(data)
+
+	w, err := store.CreateWriter(hash)
+	c.Assert(err, gc.IsNil)
+	_, err = w.Write(data)
+	c.Assert(err, gc.IsNil)
+	c.Assert(w.Cancel(), gc.IsNil)
+
+	f, err := store.Open(hash)
+	c.Assert(err, gc.Equals, mgo.ErrNotFound)
+	c.Assert(f, gc.IsNil)
+}
+
+func (s *storeSuite) TestCreateWriterHashMismatch(c *gc.C) {
+	store := blobstore.New(s.Session.DB("a-database"), "prefix")
+
+	data := []byte(`some file data`)
+	hash := hashOf([]byte("foo"))
+
+	w, err := store.CreateWriter(hash)
+	c.Assert(err, gc.IsNil)
+	_, err = w.Write(data)
+	c.Assert(err, gc.IsNil)
+	c.Assert(w.Commit(), gc.ErrorMatches, "file checksum mismatch")
+
+	f, err := store.Open(hash)
+	c.Assert(err, gc.Equals, mgo.ErrNotFound)
+	c.Assert(f, gc.IsNil)
+}